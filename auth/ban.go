@@ -0,0 +1,176 @@
+// Package auth implements moderation primitives for chat.Server: a
+// persistent ban list keyed by MAC, source IP, or username, so abusive
+// peers can be blocked before their messages are ever dispatched.
+package auth
+
+import (
+	"sync"
+	"time"
+
+	"github.com/wavyllama/chat/db"
+)
+
+// Kind identifies which field a ban applies to.
+type Kind string
+
+const (
+	KindMAC      Kind = "mac"
+	KindIP       Kind = "ip"
+	KindUsername Kind = "username"
+)
+
+// entry is a single ban with an expiry.
+type entry struct {
+	ExpiresAt time.Time
+}
+
+// BanList tracks banned MACs, IPs, and usernames in three separate maps,
+// each with its own TTL, backed by the sqlite db package so bans survive
+// a restart. Expired entries are pruned lazily on lookup. mu guards all
+// three maps, since IsBanned is called once per accepted connection from
+// its own goroutine while Ban/Unban/List can run concurrently from the CLI.
+type BanList struct {
+	mu        sync.Mutex
+	macs      map[string]entry
+	ips       map[string]entry
+	usernames map[string]entry
+}
+
+// NewBanList loads every persisted ban out of sqlite into memory; any that
+// have already expired are pruned on their first lookup.
+func NewBanList() (*BanList, error) {
+	b := &BanList{
+		macs:      make(map[string]entry),
+		ips:       make(map[string]entry),
+		usernames: make(map[string]entry),
+	}
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// load populates the in-memory maps from the bans table.
+func (b *BanList) load() error {
+	rows, err := db.DB.Query(`SELECT kind, value, expires_at FROM bans`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var kind, value string
+		var expiresAt time.Time
+		if err := rows.Scan(&kind, &value, &expiresAt); err != nil {
+			return err
+		}
+		if m := b.mapFor(Kind(kind)); m != nil {
+			m[value] = entry{ExpiresAt: expiresAt}
+		}
+	}
+	return rows.Err()
+}
+
+// mapFor returns the in-memory map backing kind, or nil for an unknown kind.
+func (b *BanList) mapFor(kind Kind) map[string]entry {
+	switch kind {
+	case KindMAC:
+		return b.macs
+	case KindIP:
+		return b.ips
+	case KindUsername:
+		return b.usernames
+	default:
+		return nil
+	}
+}
+
+// Ban blocks value under kind for duration, persisting the ban to sqlite.
+func (b *BanList) Ban(kind Kind, value string, duration time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m := b.mapFor(kind)
+	if m == nil {
+		return &UnknownKindError{Kind: kind}
+	}
+	expiresAt := time.Now().Add(duration)
+	if _, err := db.DB.Exec(
+		`INSERT INTO bans (kind, value, expires_at) VALUES (?, ?, ?)
+		 ON CONFLICT(kind, value) DO UPDATE SET expires_at = excluded.expires_at`,
+		string(kind), value, expiresAt); err != nil {
+		return err
+	}
+	m[value] = entry{ExpiresAt: expiresAt}
+	return nil
+}
+
+// Unban removes any active ban on value under kind.
+func (b *BanList) Unban(kind Kind, value string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m := b.mapFor(kind)
+	if m == nil {
+		return &UnknownKindError{Kind: kind}
+	}
+	if _, err := db.DB.Exec(`DELETE FROM bans WHERE kind = ? AND value = ?`, string(kind), value); err != nil {
+		return err
+	}
+	delete(m, value)
+	return nil
+}
+
+// IsBanned reports whether value is currently banned under kind, pruning
+// the entry first if it has expired.
+func (b *BanList) IsBanned(kind Kind, value string) bool {
+	if value == "" {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.isBannedLocked(kind, value)
+}
+
+// isBannedLocked is IsBanned's body, assuming b.mu is already held, so List
+// can prune entries without recursively locking the mutex.
+func (b *BanList) isBannedLocked(kind Kind, value string) bool {
+	m := b.mapFor(kind)
+	if m == nil {
+		return false
+	}
+	e, ok := m[value]
+	if !ok {
+		return false
+	}
+	if time.Now().After(e.ExpiresAt) {
+		delete(m, value)
+		db.DB.Exec(`DELETE FROM bans WHERE kind = ? AND value = ?`, string(kind), value)
+		return false
+	}
+	return true
+}
+
+// List returns every currently active ban, grouped by kind, pruning expired
+// entries as it goes.
+func (b *BanList) List() map[Kind][]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	result := map[Kind][]string{}
+	for kind, m := range map[Kind]map[string]entry{KindMAC: b.macs, KindIP: b.ips, KindUsername: b.usernames} {
+		for value := range m {
+			if b.isBannedLocked(kind, value) {
+				result[kind] = append(result[kind], value)
+			}
+		}
+	}
+	return result
+}
+
+// UnknownKindError is returned when a ban operation is given a Kind other
+// than KindMAC, KindIP, or KindUsername.
+type UnknownKindError struct {
+	Kind Kind
+}
+
+func (e *UnknownKindError) Error() string {
+	return "auth: unknown ban kind '" + string(e.Kind) + "'"
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wavyllama/chat/db"
+)
+
+func TestMain(m *testing.M) {
+	db.SetupDatabase()
+	m.Run()
+}
+
+func TestBanExpiry(t *testing.T) {
+	b, err := NewBanList()
+	if err != nil {
+		t.Fatalf("NewBanList: %v", err)
+	}
+	if err := b.Ban(KindIP, "10.0.0.1", time.Millisecond); err != nil {
+		t.Fatalf("Ban: %v", err)
+	}
+	if !b.IsBanned(KindIP, "10.0.0.1") {
+		t.Fatal("expected ban to be active immediately")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if b.IsBanned(KindIP, "10.0.0.1") {
+		t.Fatal("expected ban to have expired and been pruned")
+	}
+}
+
+func TestBanUnknownKind(t *testing.T) {
+	b, err := NewBanList()
+	if err != nil {
+		t.Fatalf("NewBanList: %v", err)
+	}
+	if err := b.Ban(Kind("bogus"), "x", time.Minute); err == nil {
+		t.Fatal("expected an UnknownKindError for an unrecognized kind")
+	}
+}
+
+// TestBanListConcurrentAccess exercises Ban and IsBanned from separate
+// goroutines at once, the same way a CLI ban verb and a per-connection
+// handleConnection goroutine can race in practice. Run with -race to catch
+// a regression back to the unguarded maps.
+func TestBanListConcurrentAccess(t *testing.T) {
+	b, err := NewBanList()
+	if err != nil {
+		t.Fatalf("NewBanList: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if err := b.Ban(KindUsername, "racer", time.Minute); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		b.IsBanned(KindUsername, "racer")
+	}
+	<-done
+}
@@ -0,0 +1,39 @@
+// Command relay runs a standalone chat relay: a well-known rendezvous point
+// that brokers connections between chat peers who cannot reach each other
+// directly.
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"log"
+
+	"github.com/wavyllama/chat/relay"
+)
+
+func main() {
+	controlAddr := flag.String("control-addr", ":4243", "address to accept client control connections on")
+	dataAddr := flag.String("data-addr", ":4244", "address to accept brokered data connections on")
+	certFile := flag.String("cert", "", "path to TLS certificate for the control listener")
+	keyFile := flag.String("key", "", "path to TLS key for the control listener")
+	flag.Parse()
+
+	if *certFile == "" || *keyFile == "" {
+		log.Fatalf("relay: -cert and -key are required")
+	}
+	cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+	if err != nil {
+		log.Fatalf("relay: failed to load TLS certificate: %s", err.Error())
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	s := relay.NewServer()
+	go func() {
+		if err := s.ListenAndServeData(*dataAddr); err != nil {
+			log.Fatalf("relay: data listener: %s", err.Error())
+		}
+	}()
+	if err := s.ListenAndServe(*controlAddr, tlsConfig); err != nil {
+		log.Fatalf("relay: control listener: %s", err.Error())
+	}
+}
@@ -0,0 +1,202 @@
+// Package discovery finds chat peers on the local network by periodically
+// broadcasting UDP multicast beacons and listening for the same beacons
+// from everyone else, so peers on one LAN never have to exchange IP
+// addresses out of band before calling SendFriendRequest.
+package discovery
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Group is the fixed multicast group and port beacons are sent on.
+const Group = "239.192.42.42:4243"
+
+const (
+	beaconEvery = 5 * time.Second
+	peerTTL     = 3 * beaconEvery
+)
+
+// Beacon is broadcast periodically to announce a running Server's presence.
+// IP is the sender's own claimed address; receivers reject any beacon whose
+// IP doesn't match the UDP packet's actual source, so a peer can't spoof
+// its way into another peer's cache.
+type Beacon struct {
+	Username string
+	MAC      string
+	IP       string
+	Port     uint16
+	Seq      uint64
+}
+
+// Peer is one entry in a PeerCache.
+type Peer struct {
+	Username string
+	MAC      string
+	IP       string
+	Port     uint16
+}
+
+type cacheEntry struct {
+	peer     Peer
+	lastSeen time.Time
+}
+
+// PeerCache tracks discovered peers keyed by (MAC, Username), evicting
+// entries that haven't beaconed within peerTTL.
+type PeerCache struct {
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+func newPeerCache() *PeerCache {
+	return &PeerCache{entries: make(map[string]*cacheEntry)}
+}
+
+func keyFor(mac, username string) string { return mac + "|" + username }
+
+func (c *PeerCache) put(p Peer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[keyFor(p.MAC, p.Username)] = &cacheEntry{peer: p, lastSeen: time.Now()}
+}
+
+// Peers returns every peer that has beaconed within peerTTL, pruning
+// anything older as it goes.
+func (c *PeerCache) Peers() []Peer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var result []Peer
+	for key, e := range c.entries {
+		if time.Since(e.lastSeen) > peerTTL {
+			delete(c.entries, key)
+			continue
+		}
+		result = append(result, e.peer)
+	}
+	return result
+}
+
+// Lookup returns the discovered peer with the given username, if any and
+// still within peerTTL.
+func (c *PeerCache) Lookup(username string) (Peer, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, e := range c.entries {
+		if time.Since(e.lastSeen) > peerTTL {
+			delete(c.entries, key)
+			continue
+		}
+		if e.peer.Username == username {
+			return e.peer, true
+		}
+	}
+	return Peer{}, false
+}
+
+// Service beacons this peer's presence on the LAN and listens for others',
+// populating a PeerCache.
+type Service struct {
+	self  Beacon
+	seq   uint64
+	conn  *net.UDPConn
+	cache *PeerCache
+	done  chan struct{}
+}
+
+// Start begins beaconing (username, mac, ip, port) on the fixed multicast
+// group and listening for other peers' beacons, until Stop is called.
+func Start(username, mac, ip string, port uint16) (*Service, error) {
+	addr, err := net.ResolveUDPAddr("udp4", Group)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Service{
+		self:  Beacon{Username: username, MAC: mac, IP: ip, Port: port},
+		conn:  conn,
+		cache: newPeerCache(),
+		done:  make(chan struct{}),
+	}
+	go s.sendLoop(addr)
+	go s.receiveLoop()
+	return s, nil
+}
+
+// Stop closes the multicast socket, ending both the send and receive loops.
+func (s *Service) Stop() error {
+	close(s.done)
+	return s.conn.Close()
+}
+
+// Peers returns every currently known peer.
+func (s *Service) Peers() []Peer {
+	return s.cache.Peers()
+}
+
+// Lookup resolves a username to a discovered peer, if one has beaconed
+// recently.
+func (s *Service) Lookup(username string) (Peer, bool) {
+	return s.cache.Lookup(username)
+}
+
+func (s *Service) sendLoop(addr *net.UDPAddr) {
+	ticker := time.NewTicker(beaconEvery)
+	defer ticker.Stop()
+	for {
+		s.sendBeacon(addr)
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Service) sendBeacon(addr *net.UDPAddr) {
+	b := s.self
+	b.Seq = atomic.AddUint64(&s.seq, 1)
+	payload, err := json.Marshal(&b)
+	if err != nil {
+		return
+	}
+	if _, err := s.conn.WriteToUDP(payload, addr); err != nil {
+		log.Printf("discovery: failed to send beacon: %s", err.Error())
+	}
+}
+
+func (s *Service) receiveLoop() {
+	buf := make([]byte, 1024)
+	for {
+		n, srcAddr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		var b Beacon
+		if err := json.Unmarshal(buf[:n], &b); err != nil {
+			continue
+		}
+		if b.MAC == s.self.MAC && b.Username == s.self.Username {
+			continue // our own beacon, looped back by the multicast group
+		}
+		if isSpoofedBeacon(b, srcAddr.IP.String()) {
+			log.Printf("discovery: dropping beacon claiming IP %s from actual source %s", b.IP, srcAddr.IP.String())
+			continue
+		}
+		s.cache.put(Peer{Username: b.Username, MAC: b.MAC, IP: b.IP, Port: b.Port})
+	}
+}
+
+// isSpoofedBeacon reports whether b claims an IP other than srcIP, the UDP
+// packet's actual source address, so a peer can't register itself under an
+// address it doesn't own.
+func isSpoofedBeacon(b Beacon, srcIP string) bool {
+	return b.IP != srcIP
+}
@@ -0,0 +1,38 @@
+package discovery
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsSpoofedBeaconDetectsMismatchedSource(t *testing.T) {
+	b := Beacon{Username: "alice", MAC: "AA:AA:AA:AA:AA:AA", IP: "10.0.0.5", Port: 4242}
+	if isSpoofedBeacon(b, "10.0.0.5") {
+		t.Fatal("expected a beacon whose claimed IP matches its source not to be flagged as spoofed")
+	}
+	if !isSpoofedBeacon(b, "10.0.0.99") {
+		t.Fatal("expected a beacon claiming an IP other than its actual source to be flagged as spoofed")
+	}
+}
+
+func TestPeerCachePrunesExpiredEntries(t *testing.T) {
+	c := newPeerCache()
+	c.put(Peer{Username: "alice", MAC: "AA:AA:AA:AA:AA:AA", IP: "10.0.0.5", Port: 4242})
+
+	if _, ok := c.Lookup("alice"); !ok {
+		t.Fatal("expected a freshly beaconed peer to be found")
+	}
+
+	c.mu.Lock()
+	for _, e := range c.entries {
+		e.lastSeen = time.Now().Add(-peerTTL - time.Second)
+	}
+	c.mu.Unlock()
+
+	if peers := c.Peers(); len(peers) != 0 {
+		t.Fatalf("expected Peers to prune the expired entry, got %v", peers)
+	}
+	if _, ok := c.Lookup("alice"); ok {
+		t.Fatal("expected Lookup to report the expired entry as gone")
+	}
+}
@@ -0,0 +1,156 @@
+// Package log is a small leveled logger with structured key/value context,
+// used in place of the standard library's log and fmt.Print* so server
+// output can be filtered by level, routed, silenced, or shipped as JSON to
+// a log aggregator instead of always going straight to stderr as plain
+// text.
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level orders log severity from most to least verbose.
+type Level int
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warn"
+	case ErrorLevel:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseLevel parses the --log-level flag's value.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return DebugLevel, nil
+	case "info":
+		return InfoLevel, nil
+	case "warn":
+		return WarnLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	default:
+		return 0, fmt.Errorf("log: unknown level '%s'", s)
+	}
+}
+
+// Fields is structured key/value context attached to every line a Logger
+// writes.
+type Fields map[string]interface{}
+
+// Logger writes leveled lines, as plain text or JSON, each one carrying
+// whatever Fields were accumulated via With.
+type Logger struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	level  Level
+	json   bool
+	fields Fields
+}
+
+// New creates a root Logger writing to out. Lines below minLevel are
+// dropped; asJSON switches to one JSON object per line, for running under
+// a log aggregator.
+func New(out io.Writer, minLevel Level, asJSON bool) *Logger {
+	return &Logger{mu: &sync.Mutex{}, out: out, level: minLevel, json: asJSON}
+}
+
+// With returns a derived Logger that includes fields on every line in
+// addition to its parent's, so a connection's logger can be built once
+// with peer_mac/peer_ip and every subsequent line for that peer carries
+// them without repeating them at each call site.
+func (l *Logger) With(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{mu: l.mu, out: l.out, level: l.level, json: l.json, fields: merged}
+}
+
+func (l *Logger) write(level Level, msg string) {
+	if level < l.level {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.json {
+		line := make(map[string]interface{}, len(l.fields)+3)
+		for k, v := range l.fields {
+			line[k] = v
+		}
+		line["time"] = time.Now().Format(time.RFC3339)
+		line["level"] = level.String()
+		line["msg"] = msg
+		if enc, err := json.Marshal(line); err == nil {
+			fmt.Fprintln(l.out, string(enc))
+		}
+		return
+	}
+	fmt.Fprintf(l.out, "%s [%s] %s%s\n", time.Now().Format(time.RFC3339), level.String(), msg, formatFields(l.fields))
+}
+
+// formatFields renders fields in a stable, sorted order so two lines with
+// the same context are easy to diff by eye.
+func formatFields(fields Fields) string {
+	if len(fields) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&sb, " %s=%v", k, fields[k])
+	}
+	return sb.String()
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.write(DebugLevel, fmt.Sprintf(format, args...))
+}
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.write(InfoLevel, fmt.Sprintf(format, args...))
+}
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.write(WarnLevel, fmt.Sprintf(format, args...))
+}
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.write(ErrorLevel, fmt.Sprintf(format, args...))
+}
+
+// Default is the logger used by packages that haven't been handed one of
+// their own, writing plain text at InfoLevel to stderr.
+var Default = New(os.Stderr, InfoLevel, false)
+
+func Debugf(format string, args ...interface{}) { Default.Debugf(format, args...) }
+func Infof(format string, args ...interface{})  { Default.Infof(format, args...) }
+func Warnf(format string, args ...interface{})  { Default.Warnf(format, args...) }
+func Errorf(format string, args ...interface{}) { Default.Errorf(format, args...) }
@@ -0,0 +1,73 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestWriteFiltersBelowMinLevel(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, WarnLevel, false)
+	l.Infof("should be dropped")
+	if buf.Len() != 0 {
+		t.Fatalf("expected Infof below WarnLevel to be dropped, got %q", buf.String())
+	}
+	l.Warnf("should be kept")
+	if !strings.Contains(buf.String(), "should be kept") {
+		t.Fatalf("expected Warnf at WarnLevel to be written, got %q", buf.String())
+	}
+}
+
+func TestWithMergesAndOverridesFields(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, DebugLevel, true).With(Fields{"peer_mac": "AA:AA", "round": 1})
+	derived := l.With(Fields{"round": 2, "session_id": uint64(7)})
+	derived.Infof("hello")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if line["peer_mac"] != "AA:AA" {
+		t.Fatalf("expected peer_mac to be inherited from the parent logger, got %v", line["peer_mac"])
+	}
+	if line["round"] != float64(2) {
+		t.Fatalf("expected With to override round with the derived logger's value, got %v", line["round"])
+	}
+	if line["session_id"] != float64(7) {
+		t.Fatalf("expected session_id to be present, got %v", line["session_id"])
+	}
+}
+
+func TestWritePlainTextFormat(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, DebugLevel, false).With(Fields{"peer_ip": "10.0.0.1"})
+	l.Errorf("boom: %s", "bad")
+
+	line := buf.String()
+	if !strings.Contains(line, "[error]") {
+		t.Fatalf("expected plain-text line to contain the level, got %q", line)
+	}
+	if !strings.Contains(line, "boom: bad") {
+		t.Fatalf("expected plain-text line to contain the formatted message, got %q", line)
+	}
+	if !strings.Contains(line, "peer_ip=10.0.0.1") {
+		t.Fatalf("expected plain-text line to contain its fields, got %q", line)
+	}
+}
+
+func TestWriteJSONFormat(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, DebugLevel, true).With(Fields{"peer_mac": "BB:BB"})
+	l.Debugf("hi")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("expected a single valid JSON object per line, got %q: %v", buf.String(), err)
+	}
+	if line["level"] != "debug" || line["msg"] != "hi" || line["peer_mac"] != "BB:BB" {
+		t.Fatalf("unexpected JSON line: %+v", line)
+	}
+}
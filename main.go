@@ -2,19 +2,160 @@ package main
 
 import (
 	"bufio"
-	"chat/server"
 	"chat/core"
+	"chat/db"
+	"chat/server"
+	"flag"
 	"fmt"
-	"log"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
-	"chat/db"
+	"time"
+
+	"github.com/wavyllama/chat/auth"
+	"github.com/wavyllama/chat/log"
+	"github.com/wavyllama/chat/relay"
 )
 
 const Exit = "exit"
 
+// relayEndpoints implements flag.Value so -relay can be repeated once per
+// relay to register with.
+type relayEndpoints []relay.Endpoint
+
+func (r *relayEndpoints) String() string {
+	parts := make([]string, len(*r))
+	for i, ep := range *r {
+		parts[i] = ep.Control + "," + ep.Data
+	}
+	return strings.Join(parts, " ")
+}
+
+func (r *relayEndpoints) Set(value string) error {
+	parts := strings.SplitN(value, ",", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("-relay must be 'control-addr,data-addr', got '%s'", value)
+	}
+	*r = append(*r, relay.Endpoint{Control: parts[0], Data: parts[1]})
+	return nil
+}
+
+// banKindFor maps the CLI's "mac"/"ip"/"user" spelling onto an auth.Kind.
+func banKindFor(verb string) (auth.Kind, bool) {
+	switch verb {
+	case "mac":
+		return auth.KindMAC, true
+	case "ip":
+		return auth.KindIP, true
+	case "user":
+		return auth.KindUsername, true
+	default:
+		return "", false
+	}
+}
+
+// handleBanVerb dispatches "ban <kind> <value> <duration>",
+// "unban <kind> <value>", and "banlist". It reports whether args looked like
+// one of those verbs, so listen can fall back to sending a chat message.
+func handleBanVerb(program *server.Server, args []string) bool {
+	switch args[0] {
+	case "ban":
+		if len(args) != 4 {
+			fmt.Println("usage: ban <mac|ip|user> <value> <duration>")
+			return true
+		}
+		kind, ok := banKindFor(args[1])
+		if !ok {
+			fmt.Printf("ban: unknown kind '%s'\n", args[1])
+			return true
+		}
+		duration, err := time.ParseDuration(args[3])
+		if err != nil {
+			fmt.Printf("ban: %s\n", err.Error())
+			return true
+		}
+		if err := program.Ban(kind, args[2], duration); err != nil {
+			fmt.Printf("ban: %s\n", err.Error())
+		}
+		return true
+	case "unban":
+		if len(args) != 3 {
+			fmt.Println("usage: unban <mac|ip|user> <value>")
+			return true
+		}
+		kind, ok := banKindFor(args[1])
+		if !ok {
+			fmt.Printf("unban: unknown kind '%s'\n", args[1])
+			return true
+		}
+		if err := program.Unban(kind, args[2]); err != nil {
+			fmt.Printf("unban: %s\n", err.Error())
+		}
+		return true
+	case "banlist":
+		for kind, values := range program.BanList() {
+			for _, value := range values {
+				fmt.Printf("%s: %s\n", kind, value)
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// handleDiscoverVerb prints every peer discovered on the LAN so far.
+func handleDiscoverVerb(program *server.Server, args []string) bool {
+	if args[0] != "discover" {
+		return false
+	}
+	for _, peer := range program.DiscoveredPeers() {
+		fmt.Printf("%s (%s) at %s:%d\n", peer.Username, peer.MAC, peer.IP, peer.Port)
+	}
+	return true
+}
+
+// handleRoomVerb dispatches "/room create <name> [member ...]",
+// "/room invite <name> <member>", and "/room msg <name> <text...>". It
+// reports whether args looked like one of those verbs, so listen can fall
+// back to sending a direct message.
+func handleRoomVerb(program *server.Server, args []string) bool {
+	if args[0] != "/room" {
+		return false
+	}
+	if len(args) < 3 {
+		fmt.Println("usage: /room <create|invite|msg> <name> ...")
+		return true
+	}
+	name := args[2]
+	switch args[1] {
+	case "create":
+		if err := program.CreateRoom(name, args[3:]); err != nil {
+			fmt.Printf("room: %s\n", err.Error())
+		}
+	case "invite":
+		if len(args) != 4 {
+			fmt.Println("usage: /room invite <name> <member>")
+			return true
+		}
+		if err := program.InviteToRoom(name, args[3]); err != nil {
+			fmt.Printf("room: %s\n", err.Error())
+		}
+	case "msg":
+		if len(args) < 4 {
+			fmt.Println("usage: /room msg <name> <text>")
+			return true
+		}
+		if err := program.SendRoomMessage(name, strings.Join(args[3:], " ")); err != nil {
+			fmt.Printf("room: %s\n", err.Error())
+		}
+	default:
+		fmt.Printf("room: unknown verb '%s'\n", args[1])
+	}
+	return true
+}
+
 // Listen to standard in for messages to be sent
 func listen(program *server.Server) {
 	scanner := bufio.NewScanner(os.Stdin)
@@ -24,6 +165,24 @@ func listen(program *server.Server) {
 			return
 		}
 		stringSlice := strings.Fields(message)
+		if len(stringSlice) == 0 {
+			continue
+		}
+		// A friend literally named "ban", "unban", "banlist", or "discover"
+		// must still be reachable via plain "<name> <text>", so these bare
+		// verbs only fire when no such friend exists. /room is immune to
+		// this ambiguity since it's prefixed.
+		if !program.IsFriend(stringSlice[0]) {
+			if handleBanVerb(program, stringSlice) {
+				continue
+			}
+			if handleDiscoverVerb(program, stringSlice) {
+				continue
+			}
+		}
+		if handleRoomVerb(program, stringSlice) {
+			continue
+		}
 		if err := program.Send(stringSlice[0], []byte(strings.Join(stringSlice[1:], " "))); err != nil {
 			fmt.Printf("input: %s\n", err.Error())
 		}
@@ -35,15 +194,30 @@ func listen(program *server.Server) {
 }
 
 func main() {
+	discover := flag.Bool("discover", false, "opt in to broadcasting and listening for LAN peer auto-discovery beacons")
+	logLevel := flag.String("log-level", "info", "minimum log level to emit (debug, info, warn, error)")
+	logJSON := flag.Bool("log-json", false, "emit structured JSON log lines instead of plain text, for running under a log aggregator")
+	var relays relayEndpoints
+	flag.Var(&relays, "relay", "relay 'control-addr,data-addr' pair to register with, so NAT-restricted peers can still be reached (repeatable)")
+	flag.Parse()
+
+	level, err := log.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Printf("main: %s\n", err.Error())
+		os.Exit(1)
+	}
+	logger := log.New(os.Stderr, level, *logJSON)
+
 	db.SetupDatabase()
 	mac, ip, err := core.GetAddresses()
 	if err != nil {
 		fmt.Printf("getAddresses: %s", err.Error())
 	}
 	username := core.Login(bufio.NewScanner(os.Stdin), ip)
-	var program server.Server
-	if err := program.Start(username, mac, ip); err != nil {
-		log.Fatalf("main: %s", err.Error())
+	program := server.Server{Log: logger}
+	if err := program.Start(username, mac, ip, *discover, relays...); err != nil {
+		logger.Errorf("main: %s", err.Error())
+		os.Exit(1)
 	}
 	defer program.Shutdown()
 	sig := make(chan os.Signal, 1)
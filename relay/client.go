@@ -0,0 +1,90 @@
+package relay
+
+import (
+	"crypto/tls"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Client is a single peer's handle on a relay: one control connection used
+// to register and to send/receive SessionInvitations. encMu guards enc,
+// since Invite can be called concurrently - e.g. two handleConnection
+// goroutines both falling back to the same pooled relay.Client at once -
+// and gob.Encoder isn't safe for concurrent use.
+type Client struct {
+	id       ClientID
+	dataAddr string
+	control  net.Conn
+	encMu    sync.Mutex
+	enc      *gob.Encoder
+	dec      *gob.Decoder
+}
+
+// Dial registers id with the relay's control address (TLS) and keeps the
+// control connection open for the caller to reuse. dataAddr is the relay's
+// separate plaintext data port (see Server.ListenAndServeData) that Invite
+// and WaitForInvitation dial to join a brokered session.
+func Dial(controlAddr, dataAddr string, id ClientID, tlsConfig *tls.Config) (*Client, error) {
+	conn, err := tls.Dial("tcp", controlAddr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	enc := gob.NewEncoder(conn)
+	if err := enc.Encode(&id); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Client{id: id, dataAddr: dataAddr, control: conn, enc: enc, dec: gob.NewDecoder(conn)}, nil
+}
+
+// Close tears down the control connection with the relay.
+func (c *Client) Close() error {
+	return c.control.Close()
+}
+
+// Invite asks the relay to broker a data connection to dest, then dials the
+// relay's data port and returns the resulting net.Conn as soon as it has
+// announced the session ID; it does not wait for dest to join the session.
+func (c *Client) Invite(dest ClientID) (net.Conn, error) {
+	sessionID := fmt.Sprintf("%s-%s-%d", c.id.MAC, dest.MAC, randomSuffix())
+	inv := SessionInvitation{From: c.id, To: dest, SessionID: sessionID}
+	c.encMu.Lock()
+	err := c.enc.Encode(&inv)
+	c.encMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return dialData(c.dataAddr, sessionID)
+}
+
+// WaitForInvitation blocks on the control connection for the relay to
+// forward an invitation addressed to this client, then joins the
+// corresponding data session.
+func (c *Client) WaitForInvitation() (net.Conn, error) {
+	var inv SessionInvitation
+	if err := c.dec.Decode(&inv); err != nil {
+		return nil, err
+	}
+	if inv.To != c.id {
+		return nil, errors.New("relay: received invitation addressed to another client")
+	}
+	return dialData(c.dataAddr, inv.SessionID)
+}
+
+// dialData opens the short-lived data connection a session ID was assigned
+// for, by dialing the relay's data address and announcing the session ID as
+// the first frame.
+func dialData(dataAddr, sessionID string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", dataAddr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(conn, "%s\n", sessionID); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
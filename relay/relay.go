@@ -0,0 +1,279 @@
+// Package relay implements a Syncthing-style relay for peers that cannot
+// reach each other with a direct dial, e.g. because both sides sit behind
+// NAT or a restrictive firewall. Clients keep a long-lived control
+// connection open with the relay; when one peer wants to reach another it
+// asks the relay to broker a short-lived data connection between them.
+package relay
+
+import (
+	"crypto/tls"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClientID identifies a registered client the same way server.Session does.
+type ClientID struct {
+	MAC      string
+	Username string
+}
+
+// Endpoint is one relay's pair of addresses: Control is the TLS address
+// ListenAndServe accepts registrations and SessionInvitations on, and Data
+// is the separate plaintext address ListenAndServeData accepts brokered
+// session connections on. Dial needs both, since a relay deliberately keeps
+// them on different listeners.
+type Endpoint struct {
+	Control string
+	Data    string
+}
+
+// SessionInvitation is sent by the initiating peer to the relay to ask it
+// to broker a data connection to the destination peer.
+type SessionInvitation struct {
+	From      ClientID
+	To        ClientID
+	SessionID string
+}
+
+func init() {
+	gob.Register(&SessionInvitation{})
+}
+
+// sessionTTL bounds how long an assigned session ID may go unclaimed.
+const sessionTTL = 30 * time.Second
+
+// control is the long-lived connection a client keeps open with the relay.
+type control struct {
+	id  ClientID
+	enc *gob.Encoder
+	dec *gob.Decoder
+}
+
+type pendingSession struct {
+	from, to ClientID
+	created  time.Time
+	peerConn net.Conn
+}
+
+// Server is a relay: one control connection per registered client, and a
+// broker for the short-lived data connections peers open between each other.
+type Server struct {
+	mu       sync.Mutex
+	clients  map[ClientID]*control
+	sessions map[string]*pendingSession
+}
+
+// NewServer creates an empty relay ready to accept client registrations.
+func NewServer() *Server {
+	s := &Server{
+		clients:  make(map[ClientID]*control),
+		sessions: make(map[string]*pendingSession),
+	}
+	go s.reapSessions()
+	return s
+}
+
+// reapSessions periodically closes and drops any session whose TTL expired
+// before a second peer ever joined it, so the first peer's connection -
+// stashed in pendingSession.peerConn while it waits - doesn't leak forever.
+func (s *Server) reapSessions() {
+	ticker := time.NewTicker(sessionTTL)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mu.Lock()
+		for id, sess := range s.sessions {
+			if time.Since(sess.created) > sessionTTL {
+				if sess.peerConn != nil {
+					sess.peerConn.Close()
+				}
+				delete(s.sessions, id)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// ListenAndServe accepts TLS control connections on address until an error occurs.
+func (s *Server) ListenAndServe(address string, tlsConfig *tls.Config) error {
+	ln, err := tls.Listen("tcp", address, tlsConfig)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	log.Printf("relay: listening on %s", address)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleControl(conn)
+	}
+}
+
+// handleControl registers a client's long-lived control connection and
+// forwards SessionInvitations addressed to it until the connection drops.
+func (s *Server) handleControl(conn net.Conn) {
+	dec := gob.NewDecoder(conn)
+	enc := gob.NewEncoder(conn)
+
+	var id ClientID
+	if err := dec.Decode(&id); err != nil {
+		log.Printf("relay: failed to register client: %s", err.Error())
+		conn.Close()
+		return
+	}
+
+	c := &control{id: id, enc: enc, dec: dec}
+	s.mu.Lock()
+	s.clients[id] = c
+	s.mu.Unlock()
+	log.Printf("relay: registered client %s@%s", id.Username, id.MAC)
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, id)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		var inv SessionInvitation
+		if err := dec.Decode(&inv); err != nil {
+			return
+		}
+		s.routeInvitation(inv)
+	}
+}
+
+// routeInvitation forwards an invitation to its destination's control
+// connection, if that destination is currently registered.
+func (s *Server) routeInvitation(inv SessionInvitation) {
+	s.mu.Lock()
+	dest, ok := s.clients[inv.To]
+	if ok {
+		s.sessions[inv.SessionID] = &pendingSession{from: inv.From, to: inv.To, created: time.Now()}
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	if err := dest.enc.Encode(&inv); err != nil {
+		log.Printf("relay: failed to forward invitation to %s@%s: %s", inv.To.Username, inv.To.MAC, err.Error())
+	}
+}
+
+// JoinSession is called by both sides of a brokered session once they dial
+// the relay's data port. The first call for a session ID stashes conn and
+// returns at once; the second pipes bytes between both sides and blocks
+// until either side closes.
+func (s *Server) JoinSession(sessionID string, conn net.Conn) error {
+	s.mu.Lock()
+	sess, ok := s.sessions[sessionID]
+	if ok && time.Since(sess.created) > sessionTTL {
+		delete(s.sessions, sessionID)
+		ok = false
+	}
+	s.mu.Unlock()
+	if !ok {
+		return errors.New(fmt.Sprintf("relay: unknown or expired session '%s'", sessionID))
+	}
+
+	s.mu.Lock()
+	if sess.peerConn == nil {
+		sess.peerConn = conn
+		s.mu.Unlock()
+		return nil
+	}
+	other := sess.peerConn
+	delete(s.sessions, sessionID)
+	s.mu.Unlock()
+
+	pipe(conn, other)
+	return nil
+}
+
+// ListenAndServeData accepts plaintext data connections on address. Each
+// connection announces the session ID it belongs to as a single line before
+// the relay starts piping bytes for it.
+func (s *Server) ListenAndServeData(address string) error {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	log.Printf("relay: serving data connections on %s", address)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleData(conn)
+	}
+}
+
+func (s *Server) handleData(conn net.Conn) {
+	sessionID, err := readLine(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if err := s.JoinSession(sessionID, conn); err != nil {
+		log.Printf("relay: %s", err.Error())
+		conn.Close()
+	}
+}
+
+// readLine reads one newline-terminated line from conn a byte at a time, so
+// bytes belonging to the piped session that follow are never buffered away.
+func readLine(conn net.Conn) (string, error) {
+	var sb strings.Builder
+	buf := make([]byte, 1)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			return "", err
+		}
+		if buf[0] == '\n' {
+			return sb.String(), nil
+		}
+		sb.WriteByte(buf[0])
+	}
+}
+
+// randomSuffix disambiguates session IDs from the same MAC pair.
+func randomSuffix() int64 {
+	return rand.Int63()
+}
+
+// pipe copies bytes in both directions between two data connections until
+// either side closes, then tears down both ends.
+func pipe(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	cp := func(dst, src net.Conn) {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				if _, werr := dst.Write(buf[:n]); werr != nil {
+					break
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		done <- struct{}{}
+	}
+	go cp(a, b)
+	go cp(b, a)
+	<-done
+	a.Close()
+	b.Close()
+}
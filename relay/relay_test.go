@@ -0,0 +1,81 @@
+package relay
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestJoinSessionPairsPeers exercises the broker path two real peers take:
+// the first JoinSession call for a session ID stashes its conn and returns
+// immediately, and the second pipes bytes between both sides until either
+// closes.
+func TestJoinSessionPairsPeers(t *testing.T) {
+	s := &Server{
+		clients:  make(map[ClientID]*control),
+		sessions: make(map[string]*pendingSession),
+	}
+	s.sessions["sid"] = &pendingSession{created: time.Now()}
+
+	connA, testA := net.Pipe()
+	connB, testB := net.Pipe()
+	defer testA.Close()
+	defer testB.Close()
+
+	if err := s.JoinSession("sid", connA); err != nil {
+		t.Fatalf("first JoinSession: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.JoinSession("sid", connB) }()
+
+	// JoinSession deletes the session entry before it starts piping, so by
+	// the time data flows end to end the second call has already claimed
+	// and removed it; waiting for that round trip - instead of racing the
+	// goroutine to read s.sessions right after starting it - is what
+	// actually synchronizes this check with the delete.
+	if _, err := testA.Write([]byte("hello")); err != nil {
+		t.Fatalf("write to A: %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := testB.Read(buf); err != nil {
+		t.Fatalf("read from B: %v", err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("expected 'hello' piped A->B, got %q", buf)
+	}
+
+	s.mu.Lock()
+	_, stillPending := s.sessions["sid"]
+	s.mu.Unlock()
+	if stillPending {
+		t.Fatal("expected session to be removed once both sides joined")
+	}
+
+	testA.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("second JoinSession: %v", err)
+	}
+}
+
+// TestJoinSessionRejectsExpiredSession covers the other half of the TTL
+// contract: a session nobody claimed a second peer for within sessionTTL
+// must be treated as gone, the same way reapSessions would have dropped it.
+func TestJoinSessionRejectsExpiredSession(t *testing.T) {
+	s := &Server{
+		clients:  make(map[ClientID]*control),
+		sessions: make(map[string]*pendingSession),
+	}
+	s.sessions["sid"] = &pendingSession{created: time.Now().Add(-sessionTTL - time.Second)}
+
+	conn, testConn := net.Pipe()
+	defer testConn.Close()
+	defer conn.Close()
+
+	if err := s.JoinSession("sid", conn); err == nil {
+		t.Fatal("expected an error for an expired session")
+	}
+	if _, ok := s.sessions["sid"]; ok {
+		t.Fatal("expected the expired session to be pruned")
+	}
+}
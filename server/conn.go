@@ -0,0 +1,360 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wavyllama/chat/log"
+)
+
+// msgType discriminates a frame's payload so decoding it no longer depends
+// on gob's reflective type registration (gob.Register) the way a decode
+// into the Message interface used to.
+type msgType uint8
+
+const (
+	msgTypeFriend msgType = iota + 1
+	msgTypeHandshake
+	msgTypeChat
+	msgTypePing
+	msgTypeAck
+	msgTypeError
+	msgTypeRoom
+	msgTypeRoomKeyUpdate
+)
+
+// Protocol version is a single byte: high nibble is the major version,
+// bumped on a wire-incompatible change, low nibble is the minor version,
+// bumped for additions either side can safely ignore.
+const (
+	protocolVersionMajor = 1
+	protocolVersionMinor = 0
+)
+
+func protocolVersion() uint8 {
+	return uint8(protocolVersionMajor<<4 | protocolVersionMinor)
+}
+
+func versionMajor(v uint8) uint8 { return v >> 4 }
+func versionMinor(v uint8) uint8 { return v & 0x0f }
+
+const (
+	// maxFrameLength bounds a single frame well above anything an OTR
+	// handshake round or a chat message should ever produce, so a corrupt
+	// length prefix can't make readFrame try to allocate gigabytes.
+	maxFrameLength = 1 << 20
+
+	// outboundQueueDepth bounds how many frames can be queued for a peer
+	// before the connection is considered wedged.
+	outboundQueueDepth = 64
+
+	keepaliveEvery = 15 * time.Second
+	deadPeerAfter  = 45 * time.Second
+)
+
+// frame is one unit on the wire: a 4-byte length prefix followed by a
+// 1-byte protocol version, a 1-byte msgType, an 8-byte session ID used to
+// correlate concurrent OTR handshake rounds on a shared connection, and the
+// gob-encoded payload. length counts everything after itself.
+type frame struct {
+	version   uint8
+	msgType   msgType
+	sessionID uint64
+	payload   []byte
+}
+
+func writeFrame(w io.Writer, f frame) error {
+	body := make([]byte, 10+len(f.payload))
+	body[0] = f.version
+	body[1] = uint8(f.msgType)
+	binary.BigEndian.PutUint64(body[2:10], f.sessionID)
+	copy(body[10:], f.payload)
+	if err := binary.Write(w, binary.BigEndian, uint32(len(body))); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+func readFrame(r io.Reader) (frame, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return frame{}, err
+	}
+	if length < 10 || length > maxFrameLength {
+		return frame{}, fmt.Errorf("server: invalid frame length %d", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return frame{}, err
+	}
+	return frame{
+		version:   body[0],
+		msgType:   msgType(body[1]),
+		sessionID: binary.BigEndian.Uint64(body[2:10]),
+		payload:   body[10:],
+	}, nil
+}
+
+// msgTypeFor returns the wire msgType for a concrete Message, so the sender
+// can tag a frame without the receiver needing gob.Register to decode it.
+func msgTypeFor(msg Message) (msgType, error) {
+	switch msg.(type) {
+	case *FriendMessage:
+		return msgTypeFriend, nil
+	case *HandshakeMessage:
+		return msgTypeHandshake, nil
+	case *ChatMessage:
+		return msgTypeChat, nil
+	case *RoomMessage:
+		return msgTypeRoom, nil
+	case *RoomKeyUpdate:
+		return msgTypeRoomKeyUpdate, nil
+	default:
+		return 0, fmt.Errorf("server: no wire msgType for %T", msg)
+	}
+}
+
+// decodePayload gob-decodes a frame's payload into the concrete Message
+// type its msgType names.
+func decodePayload(mt msgType, payload []byte) (Message, error) {
+	dec := gob.NewDecoder(bytes.NewReader(payload))
+	switch mt {
+	case msgTypeFriend:
+		m := new(FriendMessage)
+		if err := dec.Decode(m); err != nil {
+			return nil, err
+		}
+		return m, nil
+	case msgTypeHandshake:
+		m := new(HandshakeMessage)
+		if err := dec.Decode(m); err != nil {
+			return nil, err
+		}
+		return m, nil
+	case msgTypeChat:
+		m := new(ChatMessage)
+		if err := dec.Decode(m); err != nil {
+			return nil, err
+		}
+		return m, nil
+	case msgTypeRoom:
+		m := new(RoomMessage)
+		if err := dec.Decode(m); err != nil {
+			return nil, err
+		}
+		return m, nil
+	case msgTypeRoomKeyUpdate:
+		m := new(RoomKeyUpdate)
+		if err := dec.Decode(m); err != nil {
+			return nil, err
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("server: msgType %d is not a Message frame", mt)
+	}
+}
+
+// Conn owns a single persistent, framed connection to one peer. A write
+// goroutine drains a bounded outbound queue so a slow peer can't block a
+// caller of Server.sendMessage, a read goroutine decodes frames as they
+// arrive, and a watchdog closes the connection if the peer goes quiet for
+// too long without a clean TCP close.
+type Conn struct {
+	netConn net.Conn
+	log     *log.Logger
+
+	out       chan frame
+	done      chan struct{}
+	closeOnce sync.Once
+	closeHook func()
+
+	mu          sync.Mutex
+	lastSeen    time.Time
+	peerVersion uint8
+
+	sessionSeq uint64
+}
+
+// newConn wraps netConn for framed reads and writes, logging with logger.
+// Callers still need to start writePump/watchdog and a readLoop goroutine.
+func newConn(netConn net.Conn, logger *log.Logger) *Conn {
+	return &Conn{
+		netConn:  netConn,
+		log:      logger,
+		out:      make(chan frame, outboundQueueDepth),
+		done:     make(chan struct{}),
+		lastSeen: time.Now(),
+	}
+}
+
+func (c *Conn) touch() {
+	c.mu.Lock()
+	c.lastSeen = time.Now()
+	c.mu.Unlock()
+}
+
+func (c *Conn) idle() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Since(c.lastSeen)
+}
+
+// Close tears down the connection and runs closeHook, if set, exactly once.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if c.closeHook != nil {
+			c.closeHook()
+		}
+	})
+	return c.netConn.Close()
+}
+
+// nextSessionID hands out a connection-local, monotonically increasing ID
+// used to tag a frame so a reply to it - such as the next round of an OTR
+// handshake - can be correlated even though several rounds, for several
+// sessions with the same peer, may be in flight on the shared connection
+// at once.
+func (c *Conn) nextSessionID() uint64 {
+	return atomic.AddUint64(&c.sessionSeq, 1)
+}
+
+// enqueue queues f for the write pump without blocking: if the outbound
+// queue is already full the connection is considered wedged and torn down,
+// rather than letting one slow peer stall every caller of sendMessage.
+func (c *Conn) enqueue(f frame) error {
+	select {
+	case c.out <- f:
+		return nil
+	case <-c.done:
+		return errors.New("server: connection closed")
+	default:
+		c.Close()
+		return errors.New("server: outbound queue full, dropping connection")
+	}
+}
+
+// send gob-encodes msg and queues it as a data frame tagged with a fresh
+// session ID.
+func (c *Conn) send(mt msgType, msg Message) error {
+	return c.sendCorrelated(mt, msg, c.nextSessionID())
+}
+
+// sendCorrelated is send with an explicit session ID instead of a freshly
+// minted one, so a reply can be tagged with the session ID of the frame it
+// replies to. That's what lets several concurrent OTR handshake rounds with
+// the same peer share one connection: each round's reply carries the same
+// session ID as the round that prompted it, so the two ends can correlate
+// a reply to its request even though other rounds' frames interleave with
+// it on the wire.
+func (c *Conn) sendCorrelated(mt msgType, msg Message, sessionID uint64) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(msg); err != nil {
+		return err
+	}
+	return c.enqueue(frame{version: protocolVersion(), msgType: mt, sessionID: sessionID, payload: buf.Bytes()})
+}
+
+// sendControl queues a payload-less control frame (ACK or ERROR) tagged with
+// sessionID, acknowledging or reporting a problem with the frame sessionID
+// names.
+func (c *Conn) sendControl(mt msgType, sessionID uint64) error {
+	return c.enqueue(frame{version: protocolVersion(), msgType: mt, sessionID: sessionID})
+}
+
+// writePump drains the outbound queue onto the wire and, every
+// keepaliveEvery regardless of other traffic, sends a keepalive PING so the
+// peer's watchdog sees activity even during a long silence between chat
+// messages.
+func (c *Conn) writePump() {
+	ticker := time.NewTicker(keepaliveEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case f := <-c.out:
+			if err := writeFrame(c.netConn, f); err != nil {
+				c.Close()
+				return
+			}
+		case <-ticker.C:
+			ping := frame{version: protocolVersion(), msgType: msgTypePing, sessionID: c.nextSessionID()}
+			if err := writeFrame(c.netConn, ping); err != nil {
+				c.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// watchdog closes the connection once the peer has gone quiet for longer
+// than deadPeerAfter, catching a peer that vanished without a clean TCP
+// close (power loss, a pulled network cable) instead of leaking the conn.
+func (c *Conn) watchdog() {
+	ticker := time.NewTicker(keepaliveEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if c.idle() > deadPeerAfter {
+				c.log.Warnf("peer idle for %s, closing connection", c.idle())
+				c.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// readLoop decodes frames off the wire and hands each one other than PING,
+// ACK, and ERROR to handle, until a read fails or the connection closes. The first frame
+// negotiates the protocol version: a mismatched major version aborts the
+// connection outright, since the wire format itself may have changed; a
+// different minor version is tolerated.
+func (c *Conn) readLoop(handle func(frame)) {
+	r := bufio.NewReader(c.netConn)
+	negotiated := false
+	for {
+		f, err := readFrame(r)
+		if err != nil {
+			c.Close()
+			return
+		}
+		if !negotiated {
+			if versionMajor(f.version) != protocolVersionMajor {
+				c.log.Errorf("peer speaks incompatible protocol version %d.%d, dropping connection",
+					versionMajor(f.version), versionMinor(f.version))
+				c.Close()
+				return
+			}
+			c.mu.Lock()
+			c.peerVersion = f.version
+			c.mu.Unlock()
+			negotiated = true
+		}
+		c.touch()
+		switch f.msgType {
+		case msgTypePing:
+			continue
+		case msgTypeAck:
+			c.log.Debugf("peer acked session %d", f.sessionID)
+			continue
+		case msgTypeError:
+			c.log.Warnf("peer reported an error for session %d", f.sessionID)
+			continue
+		}
+		handle(f)
+	}
+}
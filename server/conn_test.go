@@ -0,0 +1,63 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/wavyllama/chat/log"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	f := frame{version: protocolVersion(), msgType: msgTypeChat, sessionID: 42, payload: []byte("hello")}
+	var buf bytes.Buffer
+	if err := writeFrame(&buf, f); err != nil {
+		t.Fatalf("writeFrame: %v", err)
+	}
+	got, err := readFrame(&buf)
+	if err != nil {
+		t.Fatalf("readFrame: %v", err)
+	}
+	if got.version != f.version || got.msgType != f.msgType || got.sessionID != f.sessionID || !bytes.Equal(got.payload, f.payload) {
+		t.Fatalf("round trip mismatch: got %+v, want %+v", got, f)
+	}
+}
+
+func TestReadFrameRejectsOversizedLength(t *testing.T) {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, uint32(maxFrameLength+1)); err != nil {
+		t.Fatalf("binary.Write: %v", err)
+	}
+	if _, err := readFrame(&buf); err == nil {
+		t.Fatal("expected readFrame to reject a length over maxFrameLength")
+	}
+}
+
+func TestReadLoopRejectsVersionMismatch(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+
+	c := newConn(serverConn, log.Default)
+	handled := make(chan frame, 1)
+	done := make(chan struct{})
+	go func() {
+		c.readLoop(func(f frame) { handled <- f })
+		close(done)
+	}()
+
+	badVersion := uint8((protocolVersionMajor+1)<<4 | protocolVersionMinor)
+	if err := writeFrame(clientConn, frame{version: badVersion, msgType: msgTypePing, sessionID: 1}); err != nil {
+		t.Fatalf("writeFrame: %v", err)
+	}
+
+	select {
+	case <-handled:
+		t.Fatal("handle was called for a version-mismatched frame")
+	case <-done:
+		// readLoop closed the connection, as expected.
+	case <-time.After(time.Second):
+		t.Fatal("readLoop did not close the connection on version mismatch")
+	}
+}
@@ -0,0 +1,533 @@
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/wavyllama/chat/core"
+	"github.com/wavyllama/chat/db"
+)
+
+// RoomMessage carries ciphertext addressed to every member of a room rather
+// than a single peer. RoomID names the room, and Ciphertext is AES-GCM
+// sealed under the sender's current ratchet key for that room.
+type RoomMessage struct {
+	Payload
+	RoomID     string
+	Ciphertext []byte
+}
+
+// RoomKeyUpdate rekeys a room after a membership change. Sealed is a
+// gob-encoded roomKeyPayload, encrypted under the pairwise session the room
+// owner already holds with the recipient - the same session HandshakeMessage
+// establishes and ChatMessage encrypts under - so a recipient only accepts
+// the new epoch, key, and membership if whoever sent them actually holds
+// that session's key material, not just whoever a frame's source fields
+// claim to be.
+type RoomKeyUpdate struct {
+	Payload
+	RoomID string
+	Sealed []byte
+}
+
+// roomKeyPayload is the plaintext sealed inside a RoomKeyUpdate.
+type roomKeyPayload struct {
+	Name    string
+	Epoch   uint64
+	Key     []byte
+	Members []string
+}
+
+// roomKeyCipher is the slice of protocol.Protocol a RoomKeyUpdate is sealed
+// and opened with. It's narrowed to just Encrypt/Decrypt, rather than
+// spelled as protocol.Protocol itself, so sealRoomKeyUpdate/openRoomKeyUpdate
+// can be exercised without standing up a real OTR session.
+type roomKeyCipher interface {
+	Encrypt([]byte) ([][]byte, error)
+	Decrypt([]byte) ([][]byte, error)
+}
+
+// sealRoomKeyUpdate gob-encodes payload and encrypts it under cipher, the
+// sender's pairwise session with the recipient.
+func sealRoomKeyUpdate(cipher roomKeyCipher, payload roomKeyPayload) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(payload); err != nil {
+		return nil, err
+	}
+	sealed, err := cipher.Encrypt(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) == 0 || sealed[0] == nil {
+		return nil, errors.New("server: room key cipher returned no ciphertext")
+	}
+	return sealed[0], nil
+}
+
+// openRoomKeyUpdate reverses sealRoomKeyUpdate.
+func openRoomKeyUpdate(cipher roomKeyCipher, sealed []byte) (roomKeyPayload, error) {
+	dec, err := cipher.Decrypt(sealed)
+	if err != nil {
+		return roomKeyPayload{}, err
+	}
+	if len(dec) == 0 || dec[0] == nil {
+		return roomKeyPayload{}, errors.New("server: room key cipher returned no plaintext")
+	}
+	var payload roomKeyPayload
+	if err := gob.NewDecoder(bytes.NewReader(dec[0])).Decode(&payload); err != nil {
+		return roomKeyPayload{}, err
+	}
+	return payload, nil
+}
+
+// roomSession tracks one room's membership and the epoch key its
+// per-sender ratchets are derived from.
+type roomSession struct {
+	ID    string
+	Name  string
+	Owner sourceFingerprintID // the identity allowed to issue RoomKeyUpdates
+
+	mu      sync.Mutex
+	epoch   uint64
+	roomKey []byte
+	members map[string]bool // display names, local to this user's friend list
+}
+
+// sourceFingerprintID is the wire identity - MAC plus account username - a
+// RoomKeyUpdate must claim to be from to be honored.
+type sourceFingerprintID struct {
+	MAC      string
+	Username string
+}
+
+// memberNames returns members' display names as a slice, for roomKeyPayload
+// and for persisting to db.SaveRoom.
+func memberNames(members map[string]bool) []string {
+	names := make([]string, 0, len(members))
+	for m := range members {
+		names = append(names, m)
+	}
+	return names
+}
+
+// deriveSenderKey turns a room's shared epoch key into the ratchet key a
+// single sender encrypts with, so compromising one member's traffic doesn't
+// expose what anyone else in the room sent.
+func deriveSenderKey(epochKey []byte, senderUsername string) []byte {
+	mac := hmac.New(sha256.New, epochKey)
+	mac.Write([]byte(senderUsername))
+	return mac.Sum(nil)
+}
+
+// sealRoomMessage encrypts text under sender's ratchet key for epochKey.
+func sealRoomMessage(epochKey []byte, senderUsername string, text []byte) ([]byte, error) {
+	block, err := aes.NewCipher(deriveSenderKey(epochKey, senderUsername))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, text, nil), nil
+}
+
+// openRoomMessage reverses sealRoomMessage.
+func openRoomMessage(epochKey []byte, senderUsername string, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(deriveSenderKey(epochKey, senderUsername))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("server: room ciphertext shorter than a nonce")
+	}
+	nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, nil)
+}
+
+// newEpochKey generates a fresh 32-byte AES-256 key for a room epoch.
+func newEpochKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// loadRooms restores room metadata, epoch keys, and membership persisted by
+// SaveRoom, symmetric to auth.BanList.load(), so a restart doesn't silently
+// drop every room's membership and leave SendRoomMessage fanning out to
+// nobody until the owner manually re-invites everyone.
+func (s *Server) loadRooms() error {
+	rows, err := db.DB.Query(`SELECT id, name, owner_mac, owner_username, epoch, key FROM rooms`)
+	if err != nil {
+		return err
+	}
+	type roomRow struct {
+		id, name, ownerMAC, ownerUsername string
+		epoch                             uint64
+		key                               []byte
+	}
+	var roomRows []roomRow
+	for rows.Next() {
+		var r roomRow
+		if err := rows.Scan(&r.id, &r.name, &r.ownerMAC, &r.ownerUsername, &r.epoch, &r.key); err != nil {
+			rows.Close()
+			return err
+		}
+		roomRows = append(roomRows, r)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	rows.Close()
+
+	for _, r := range roomRows {
+		members, err := db.LoadRoomMembers(r.id)
+		if err != nil {
+			return err
+		}
+		memberSet := make(map[string]bool, len(members)+1)
+		memberSet[core.Self] = true
+		for _, m := range members {
+			memberSet[m] = true
+		}
+		s.rooms[r.id] = &roomSession{
+			ID:      r.id,
+			Name:    r.name,
+			Owner:   sourceFingerprintID{MAC: r.ownerMAC, Username: r.ownerUsername},
+			epoch:   r.epoch,
+			roomKey: r.key,
+			members: memberSet,
+		}
+	}
+	return nil
+}
+
+// CreateRoom starts a new room owned by the local user with the given
+// initial members (friend display names), persists it, and sends each
+// member a RoomKeyUpdate inviting them in.
+func (s *Server) CreateRoom(name string, members []string) error {
+	s.roomsMu.Lock()
+	if _, exists := s.rooms[name]; exists {
+		s.roomsMu.Unlock()
+		return fmt.Errorf("server: room '%s' already exists", name)
+	}
+	s.roomsMu.Unlock()
+
+	key, err := newEpochKey()
+	if err != nil {
+		return err
+	}
+	memberSet := map[string]bool{core.Self: true}
+	for _, m := range members {
+		memberSet[m] = true
+	}
+	room := &roomSession{
+		ID:      name,
+		Name:    name,
+		Owner:   sourceFingerprintID{MAC: s.User.MAC, Username: s.User.Username},
+		epoch:   1,
+		roomKey: key,
+		members: memberSet,
+	}
+
+	s.roomsMu.Lock()
+	s.rooms[name] = room
+	s.roomsMu.Unlock()
+
+	if err := db.SaveRoom(room.ID, room.Name, s.User.MAC, s.User.Username, room.epoch, room.roomKey, memberNames(memberSet)); err != nil {
+		return err
+	}
+
+	for m := range memberSet {
+		if m == core.Self {
+			continue
+		}
+		if err := s.sendRoomKeyUpdate(room, m); err != nil {
+			s.Log.Warnf("failed to invite '%s' to room '%s': %s", m, name, err.Error())
+		}
+	}
+	return nil
+}
+
+// InviteToRoom adds memberDisplayName to name, rekeys it since membership
+// changed, persists the change, and sends every member - the new one
+// included - the new epoch key. Only the room's owner may invite.
+func (s *Server) InviteToRoom(name, memberDisplayName string) error {
+	s.roomsMu.Lock()
+	room, ok := s.rooms[name]
+	s.roomsMu.Unlock()
+	if !ok {
+		return fmt.Errorf("server: not in room '%s'", name)
+	}
+	if room.Owner != (sourceFingerprintID{MAC: s.User.MAC, Username: s.User.Username}) {
+		return fmt.Errorf("server: only the owner of '%s' can invite new members", name)
+	}
+
+	key, err := newEpochKey()
+	if err != nil {
+		return err
+	}
+	room.mu.Lock()
+	room.members[memberDisplayName] = true
+	room.epoch++
+	room.roomKey = key
+	members := memberNames(room.members)
+	room.mu.Unlock()
+
+	if err := db.SaveRoom(room.ID, room.Name, s.User.MAC, s.User.Username, room.epoch, room.roomKey, members); err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, m := range members {
+		if m == core.Self {
+			continue
+		}
+		if err := s.sendRoomKeyUpdate(room, m); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// sessionCipherFor returns the active pairwise session already established
+// with mac/username, as a roomKeyCipher, so a RoomKeyUpdate can be sealed or
+// opened under it. It fails if no session exists yet or the handshake for
+// one hasn't completed, since there's nothing to authenticate the update
+// against in either case.
+func (s *Server) sessionCipherFor(mac, username string) (roomKeyCipher, error) {
+	sessions := s.GetSessionsWithFriend(mac, username)
+	if len(sessions) == 0 || !sessions[0].Proto.IsActive() {
+		return nil, fmt.Errorf("no active session with %s/%s to authenticate a RoomKeyUpdate", mac, username)
+	}
+	return sessions[0].Proto, nil
+}
+
+// sendRoomKeyUpdate seals the room's current epoch key under the pairwise
+// session the local user holds with the friend with the given display name,
+// and sends it to them.
+func (s *Server) sendRoomKeyUpdate(room *roomSession, memberDisplayName string) error {
+	friend := s.User.GetFriendByDisplayName(memberDisplayName)
+	if friend == nil {
+		return fmt.Errorf("server: no friend named '%s' to invite to room '%s'", memberDisplayName, room.Name)
+	}
+	cipher, err := s.sessionCipherFor(friend.MAC, friend.Username)
+	if err != nil {
+		return fmt.Errorf("server: cannot send RoomKeyUpdate for '%s': %s", room.Name, err.Error())
+	}
+
+	room.mu.Lock()
+	payload := roomKeyPayload{Name: room.Name, Epoch: room.epoch, Key: room.roomKey, Members: memberNames(room.members)}
+	room.mu.Unlock()
+
+	sealed, err := sealRoomKeyUpdate(cipher, payload)
+	if err != nil {
+		return err
+	}
+	update := new(RoomKeyUpdate)
+	update.RoomID = room.ID
+	update.Sealed = sealed
+	update.NewPayload(s.User.MAC, s.User.Username, friend.Username)
+	return s.sendMessage(friend.IP, friend.MAC, friend.Username, update)
+}
+
+// JoinRoom accepts a RoomKeyUpdate claiming to be from owner: it requires an
+// active pairwise session with owner and a Sealed payload that session can
+// actually decrypt, so a RoomKeyUpdate can no longer be forged just by
+// setting a frame's source fields - including by a malicious or compromised
+// relay - before any of its epoch, key, or membership claims are trusted. An
+// update, for a known or an unknown room, is only honored from a known
+// friend, the same gate HandshakeMessage already applies.
+func (s *Server) JoinRoom(update *RoomKeyUpdate, owner sourceFingerprintID) error {
+	if s.User.GetFriendByUsernameAndMAC(owner.Username, owner.MAC) == nil {
+		return fmt.Errorf("server: rejecting RoomKeyUpdate for '%s' from non-friend %+v", update.RoomID, owner)
+	}
+	cipher, err := s.sessionCipherFor(owner.MAC, owner.Username)
+	if err != nil {
+		return fmt.Errorf("server: rejecting RoomKeyUpdate for '%s': %s", update.RoomID, err.Error())
+	}
+	payload, err := openRoomKeyUpdate(cipher, update.Sealed)
+	if err != nil {
+		return fmt.Errorf("server: rejecting RoomKeyUpdate for '%s': failed to authenticate: %s", update.RoomID, err.Error())
+	}
+	return s.applyRoomKeyUpdate(update.RoomID, payload, owner)
+}
+
+// applyRoomKeyUpdate folds an already-authenticated roomKeyPayload into room
+// state: creating the room on its first update, rejecting anything claiming
+// to be from someone other than the room's recorded owner, and rejecting any
+// epoch at or behind the current one so a replayed update can't roll a room
+// back to a key an ousted member still holds. Split out from JoinRoom so
+// this state-transition logic is testable without a real pairwise session.
+func (s *Server) applyRoomKeyUpdate(roomID string, payload roomKeyPayload, owner sourceFingerprintID) error {
+	s.roomsMu.Lock()
+	room, exists := s.rooms[roomID]
+	s.roomsMu.Unlock()
+	if !exists {
+		members := make(map[string]bool, len(payload.Members))
+		for _, m := range payload.Members {
+			members[m] = true
+		}
+		s.roomsMu.Lock()
+		if room, exists = s.rooms[roomID]; !exists {
+			room = &roomSession{ID: roomID, Name: payload.Name, Owner: owner, members: members}
+			s.rooms[roomID] = room
+		}
+		s.roomsMu.Unlock()
+	}
+
+	if room.Owner != owner {
+		return fmt.Errorf("server: rejecting RoomKeyUpdate for '%s' from non-owner %+v", room.Name, owner)
+	}
+
+	room.mu.Lock()
+	if payload.Epoch <= room.epoch {
+		room.mu.Unlock()
+		return fmt.Errorf("server: rejecting stale RoomKeyUpdate for '%s': epoch %d <= current epoch %d", room.Name, payload.Epoch, room.epoch)
+	}
+	room.epoch = payload.Epoch
+	room.roomKey = payload.Key
+	if payload.Members != nil {
+		members := make(map[string]bool, len(payload.Members))
+		for _, m := range payload.Members {
+			members[m] = true
+		}
+		room.members = members
+	}
+	memberList := memberNames(room.members)
+	room.mu.Unlock()
+
+	return db.SaveRoom(room.ID, room.Name, owner.MAC, owner.Username, payload.Epoch, payload.Key, memberList)
+}
+
+// LeaveRoom removes the local user from name. If the local user owns the
+// room, it rekeys and notifies the remaining members so the departing
+// member's ratchet key stops being usable; leaving a room you don't own
+// just drops local state; the owner learns of the departure out of band.
+func (s *Server) LeaveRoom(name string) error {
+	s.roomsMu.Lock()
+	room, ok := s.rooms[name]
+	if ok {
+		delete(s.rooms, name)
+	}
+	s.roomsMu.Unlock()
+	if !ok {
+		return fmt.Errorf("server: not in room '%s'", name)
+	}
+
+	if room.Owner != (sourceFingerprintID{MAC: s.User.MAC, Username: s.User.Username}) {
+		return nil
+	}
+
+	key, err := newEpochKey()
+	if err != nil {
+		return err
+	}
+	room.mu.Lock()
+	delete(room.members, core.Self)
+	room.epoch++
+	room.roomKey = key
+	members := memberNames(room.members)
+	room.mu.Unlock()
+
+	var lastErr error
+	for _, m := range members {
+		if err := s.sendRoomKeyUpdate(room, m); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// SendRoomMessage encrypts text under the local user's ratchet key for
+// room name and fans it out to every other member. It errors instead of
+// silently succeeding if there's nobody else in the room to send to, since
+// that's otherwise indistinguishable from every member having failed.
+func (s *Server) SendRoomMessage(name, text string) error {
+	s.roomsMu.Lock()
+	room, ok := s.rooms[name]
+	s.roomsMu.Unlock()
+	if !ok {
+		return fmt.Errorf("server: not in room '%s'", name)
+	}
+
+	room.mu.Lock()
+	ciphertext, err := sealRoomMessage(room.roomKey, s.User.Username, []byte(text))
+	members := memberNames(room.members)
+	room.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	sent := 0
+	for _, m := range members {
+		if m == core.Self {
+			continue
+		}
+		friend := s.User.GetFriendByDisplayName(m)
+		if friend == nil {
+			continue
+		}
+		sent++
+		msg := new(RoomMessage)
+		msg.RoomID = room.ID
+		msg.Ciphertext = ciphertext
+		msg.NewPayload(s.User.MAC, s.User.Username, friend.Username)
+		if err := s.sendMessage(friend.IP, friend.MAC, friend.Username, msg); err != nil {
+			lastErr = err
+		}
+	}
+	if sent == 0 {
+		return fmt.Errorf("server: room '%s' has no other members to send to", name)
+	}
+	return lastErr
+}
+
+// dispatchRoomMessage decrypts an incoming RoomMessage with the sender's
+// ratchet key and prints it, mirroring the ChatMessage case.
+func (s *Server) dispatchRoomMessage(sourceUsername string, msg *RoomMessage) {
+	s.roomsMu.Lock()
+	room, ok := s.rooms[msg.RoomID]
+	s.roomsMu.Unlock()
+	if !ok {
+		s.Log.Warnf("dropping message for unknown room '%s'", msg.RoomID)
+		return
+	}
+	room.mu.Lock()
+	text, err := openRoomMessage(room.roomKey, sourceUsername, msg.Ciphertext)
+	name := room.Name
+	room.mu.Unlock()
+	if err != nil {
+		s.Log.Errorf("failed to decrypt message in room '%s': %s", name, err.Error())
+		return
+	}
+	fmt.Printf("[%s] %s: %s\n", name, sourceUsername, text)
+}
+
+// dispatchRoomKeyUpdate routes an incoming RoomKeyUpdate through JoinRoom.
+func (s *Server) dispatchRoomKeyUpdate(sourceMAC, sourceUsername string, update *RoomKeyUpdate) {
+	owner := sourceFingerprintID{MAC: sourceMAC, Username: sourceUsername}
+	if err := s.JoinRoom(update, owner); err != nil {
+		s.Log.Warnf("%s", err.Error())
+	}
+}
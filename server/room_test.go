@@ -0,0 +1,199 @@
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/wavyllama/chat/db"
+	"github.com/wavyllama/chat/log"
+)
+
+// fakeRoomKeyCipher round-trips sealRoomKeyUpdate/openRoomKeyUpdate as a
+// no-op, enough to exercise the gob encode/decode without a real OTR
+// session.
+type fakeRoomKeyCipher struct{}
+
+func (fakeRoomKeyCipher) Encrypt(plaintext []byte) ([][]byte, error) { return [][]byte{plaintext}, nil }
+func (fakeRoomKeyCipher) Decrypt(ciphertext []byte) ([][]byte, error) {
+	return [][]byte{ciphertext}, nil
+}
+
+// rejectingRoomKeyCipher simulates decrypting under the wrong session.
+type rejectingRoomKeyCipher struct{}
+
+func (rejectingRoomKeyCipher) Encrypt(plaintext []byte) ([][]byte, error) {
+	return [][]byte{plaintext}, nil
+}
+func (rejectingRoomKeyCipher) Decrypt([]byte) ([][]byte, error) {
+	return nil, errors.New("fake: wrong session")
+}
+
+func TestSealOpenRoomKeyUpdateRoundTrip(t *testing.T) {
+	payload := roomKeyPayload{Name: "room", Epoch: 3, Key: []byte("key"), Members: []string{"me", "owner"}}
+	sealed, err := sealRoomKeyUpdate(fakeRoomKeyCipher{}, payload)
+	if err != nil {
+		t.Fatalf("sealRoomKeyUpdate: %v", err)
+	}
+	got, err := openRoomKeyUpdate(fakeRoomKeyCipher{}, sealed)
+	if err != nil {
+		t.Fatalf("openRoomKeyUpdate: %v", err)
+	}
+	if got.Name != "room" || got.Epoch != 3 || string(got.Key) != "key" || len(got.Members) != 2 {
+		t.Fatalf("unexpected payload: %+v", got)
+	}
+}
+
+func TestOpenRoomKeyUpdateRejectsWrongSession(t *testing.T) {
+	sealed, err := sealRoomKeyUpdate(fakeRoomKeyCipher{}, roomKeyPayload{Name: "room", Epoch: 1, Key: []byte("key")})
+	if err != nil {
+		t.Fatalf("sealRoomKeyUpdate: %v", err)
+	}
+	if _, err := openRoomKeyUpdate(rejectingRoomKeyCipher{}, sealed); err == nil {
+		t.Fatal("expected opening a RoomKeyUpdate under the wrong session to fail")
+	}
+}
+
+func TestMain(m *testing.M) {
+	db.SetupDatabase()
+	m.Run()
+}
+
+func TestSealOpenRoomMessageRoundTrip(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	ciphertext, err := sealRoomMessage(key, "alice", []byte("hello room"))
+	if err != nil {
+		t.Fatalf("sealRoomMessage: %v", err)
+	}
+	plaintext, err := openRoomMessage(key, "alice", ciphertext)
+	if err != nil {
+		t.Fatalf("openRoomMessage: %v", err)
+	}
+	if string(plaintext) != "hello room" {
+		t.Fatalf("expected 'hello room', got %q", plaintext)
+	}
+}
+
+func TestOpenRoomMessageRejectsWrongSender(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	ciphertext, err := sealRoomMessage(key, "alice", []byte("hello room"))
+	if err != nil {
+		t.Fatalf("sealRoomMessage: %v", err)
+	}
+	if _, err := openRoomMessage(key, "bob", ciphertext); err == nil {
+		t.Fatal("expected decrypting under a different sender's ratchet key to fail")
+	}
+}
+
+// newTestServer returns a Server with just enough set up for JoinRoom:
+// a local user with no friends yet, an empty session list, and an empty
+// room table.
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	return &Server{
+		User:     &db.User{"me", "AA:AA:AA:AA:AA:AA", "10.0.0.1"},
+		Log:      log.Default,
+		Sessions: &[]Session{},
+		rooms:    make(map[string]*roomSession),
+	}
+}
+
+func TestJoinRoomRejectsUnknownRoomFromNonFriend(t *testing.T) {
+	s := newTestServer(t)
+	owner := sourceFingerprintID{MAC: "BB:BB:BB:BB:BB:BB", Username: "owner"}
+	update := &RoomKeyUpdate{RoomID: "new-room"}
+
+	if err := s.JoinRoom(update, owner); err == nil {
+		t.Fatal("expected a RoomKeyUpdate for an unknown room from a non-friend to be rejected")
+	}
+	if _, exists := s.rooms["new-room"]; exists {
+		t.Fatal("expected no room state to be created for the rejected update")
+	}
+}
+
+// TestJoinRoomRejectsUpdateWithoutAuthenticatedSession covers the actual
+// fix: even an update claiming to be from a known friend who is the room's
+// recorded owner is rejected when there's no active pairwise session to
+// authenticate it against, since the claimed source fields alone are just
+// whatever an attacker - or a malicious relay - put on the frame.
+func TestJoinRoomRejectsUpdateWithoutAuthenticatedSession(t *testing.T) {
+	s := newTestServer(t)
+	owner := sourceFingerprintID{MAC: "BB:BB:BB:BB:BB:BB", Username: "owner"}
+	s.User.AddFriend("owner", owner.MAC, "10.0.0.2", owner.Username)
+	s.rooms["room"] = &roomSession{
+		ID: "room", Name: "room", Owner: owner,
+		epoch: 1, roomKey: []byte("old-key"), members: map[string]bool{"me": true},
+	}
+
+	update := &RoomKeyUpdate{RoomID: "room", Sealed: []byte("forged, unauthenticated payload")}
+	if err := s.JoinRoom(update, owner); err == nil {
+		t.Fatal("expected a RoomKeyUpdate to be rejected without an authenticated session to verify it against")
+	}
+	s.roomsMu.Lock()
+	room := s.rooms["room"]
+	s.roomsMu.Unlock()
+	if room.epoch != 1 || string(room.roomKey) != "old-key" {
+		t.Fatal("expected a rejected RoomKeyUpdate not to change room state")
+	}
+}
+
+// The remaining JoinRoom tests exercise applyRoomKeyUpdate directly: the
+// state-transition logic that runs once a RoomKeyUpdate's payload has
+// already been authenticated, decoupled from needing a real pairwise
+// session to get there.
+
+func TestApplyRoomKeyUpdateRejectsNonOwnerUpdate(t *testing.T) {
+	s := newTestServer(t)
+	owner := sourceFingerprintID{MAC: "BB:BB:BB:BB:BB:BB", Username: "owner"}
+	impostor := sourceFingerprintID{MAC: "CC:CC:CC:CC:CC:CC", Username: "impostor"}
+	s.rooms["room"] = &roomSession{
+		ID: "room", Name: "room", Owner: owner,
+		epoch: 1, roomKey: []byte("key"), members: map[string]bool{"me": true},
+	}
+
+	payload := roomKeyPayload{Name: "room", Epoch: 2, Key: []byte("new-key")}
+	if err := s.applyRoomKeyUpdate("room", payload, impostor); err == nil {
+		t.Fatal("expected a RoomKeyUpdate from a non-owner identity to be rejected")
+	}
+}
+
+func TestApplyRoomKeyUpdateRejectsStaleEpoch(t *testing.T) {
+	s := newTestServer(t)
+	owner := sourceFingerprintID{MAC: "BB:BB:BB:BB:BB:BB", Username: "owner"}
+	s.rooms["room"] = &roomSession{
+		ID: "room", Name: "room", Owner: owner,
+		epoch: 5, roomKey: []byte("key"), members: map[string]bool{"me": true},
+	}
+
+	for _, epoch := range []uint64{5, 3} {
+		payload := roomKeyPayload{Name: "room", Epoch: epoch, Key: []byte("replayed-key")}
+		if err := s.applyRoomKeyUpdate("room", payload, owner); err == nil {
+			t.Fatalf("expected epoch %d <= current epoch 5 to be rejected", epoch)
+		}
+	}
+	s.roomsMu.Lock()
+	room := s.rooms["room"]
+	s.roomsMu.Unlock()
+	if room.epoch != 5 || string(room.roomKey) != "key" {
+		t.Fatal("expected a rejected RoomKeyUpdate not to change room state")
+	}
+}
+
+func TestApplyRoomKeyUpdateAcceptsAdvancingEpoch(t *testing.T) {
+	s := newTestServer(t)
+	owner := sourceFingerprintID{MAC: "BB:BB:BB:BB:BB:BB", Username: "owner"}
+	s.rooms["room"] = &roomSession{
+		ID: "room", Name: "room", Owner: owner,
+		epoch: 1, roomKey: []byte("old-key"), members: map[string]bool{"me": true},
+	}
+
+	payload := roomKeyPayload{Name: "room", Epoch: 2, Key: []byte("new-key")}
+	if err := s.applyRoomKeyUpdate("room", payload, owner); err != nil {
+		t.Fatalf("applyRoomKeyUpdate: %v", err)
+	}
+	s.roomsMu.Lock()
+	room := s.rooms["room"]
+	s.roomsMu.Unlock()
+	if room.epoch != 2 || string(room.roomKey) != "new-key" {
+		t.Fatal("expected an advancing epoch to rekey the room")
+	}
+}
@@ -1,16 +1,20 @@
 package server
 
 import (
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/wavyllama/chat/auth"
+	"github.com/wavyllama/chat/core"
 	"github.com/wavyllama/chat/db"
+	"github.com/wavyllama/chat/discovery"
+	"github.com/wavyllama/chat/log"
 	"github.com/wavyllama/chat/protocol"
-	"log"
+	"github.com/wavyllama/chat/relay"
 	"net"
+	"sync"
 	"time"
-	"encoding/gob"
-	"encoding/json"
-	"github.com/wavyllama/chat/core"
 )
 
 const (
@@ -23,12 +27,106 @@ type Server struct {
 	User     *db.User
 	Listener *net.TCPListener
 	Sessions *[]Session
+	relays   []*relay.Client
+	Bans     *auth.BanList
+	pool     *connPool
+	disco    *discovery.Service
+
+	// Log is the root logger Start attaches to the server and every
+	// connection it accepts or dials. Callers may set it before calling
+	// Start to control level and output format; it defaults to log.Default.
+	Log *log.Logger
+
+	roomsMu sync.Mutex
+	rooms   map[string]*roomSession
+}
+
+// peerKey identifies a peer for the purposes of the connection pool, the
+// same way relay.ClientID identifies one for a relay.
+type peerKey struct {
+	MAC      string
+	Username string
+}
+
+// connPool caches one persistent, framed Conn per peer so repeated calls to
+// sendMessage reuse a connection instead of dialing fresh for every message.
+// dialMu holds one lock per peer, lazily created, so connFor can serialize
+// the check-dial-put sequence for a given peer without serializing dials to
+// unrelated peers.
+type connPool struct {
+	mu     sync.Mutex
+	conns  map[peerKey]*Conn
+	dialMu map[peerKey]*sync.Mutex
+}
+
+func newConnPool() *connPool {
+	return &connPool{conns: make(map[peerKey]*Conn), dialMu: make(map[peerKey]*sync.Mutex)}
+}
+
+func (p *connPool) get(key peerKey) *Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conns[key]
+}
+
+func (p *connPool) put(key peerKey, c *Conn) {
+	p.mu.Lock()
+	p.conns[key] = c
+	p.mu.Unlock()
+}
+
+func (p *connPool) remove(key peerKey, c *Conn) {
+	p.mu.Lock()
+	if p.conns[key] == c {
+		delete(p.conns, key)
+	}
+	p.mu.Unlock()
+}
+
+// lockDial returns key's dial lock, creating it on first use, so connFor
+// can hold it across its whole check-dial-put sequence for that peer.
+func (p *connPool) lockDial(key peerKey) *sync.Mutex {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m, ok := p.dialMu[key]
+	if !ok {
+		m = &sync.Mutex{}
+		p.dialMu[key] = m
+	}
+	return m
+}
+
+// sourceFingerprint bundles the identifiers a decoded message carries, so
+// FriendMessage, HandshakeMessage, and ChatMessage can all be screened
+// against the ban list the same way.
+type sourceFingerprint struct {
+	MAC      string
+	IP       string
+	Username string
 }
 
-func init() {
-	gob.Register(&FriendMessage{})
-	gob.Register(&HandshakeMessage{})
-	gob.Register(&ChatMessage{})
+// isBanned reports whether any identifier in fp matches an active ban.
+func (s *Server) isBanned(fp sourceFingerprint) bool {
+	return s.Bans.IsBanned(auth.KindMAC, fp.MAC) ||
+		s.Bans.IsBanned(auth.KindIP, fp.IP) ||
+		s.Bans.IsBanned(auth.KindUsername, fp.Username)
+}
+
+// Ban blocks value under kind (auth.KindMAC, auth.KindIP, or
+// auth.KindUsername) for duration, so future messages from it are dropped
+// in handleConnection.
+func (s *Server) Ban(kind auth.Kind, value string, duration time.Duration) error {
+	return s.Bans.Ban(kind, value, duration)
+}
+
+// Unban lifts any active ban on value under kind.
+func (s *Server) Unban(kind auth.Kind, value string) error {
+	return s.Bans.Unban(kind, value)
+}
+
+// BanList returns every currently active ban, grouped by kind.
+func (s *Server) BanList() map[auth.Kind][]string {
+	return s.Bans.List()
 }
 
 // Setup listener for the server
@@ -40,26 +138,61 @@ func setupServer(address string) (*net.TCPListener, error) {
 	return net.ListenTCP(Network, tcpAddr)
 }
 
-// Handle receiving messages from a TCPConn
-func (s *Server) handleConnection(conn *net.TCPConn) {
-	defer conn.Close()
-	decoder := gob.NewDecoder(conn)
-	var msg Message
-	if err := decoder.Decode(&msg); err != nil {
-		log.Panicf("Error decoding message: %s", err.Error())
-	}
+// handleConnection takes ownership of a persistent, framed connection -
+// direct TCP accept or a data connection brokered by a relay, the frames on
+// the wire are identical either way - and dispatches every Message frame it
+// decodes until the peer disconnects. This replaces the old one-decode-
+// per-accept model, so a single connection now carries a whole back-and-
+// forth of handshake rounds, chat, and keepalives instead of being torn
+// down after one message.
+func (s *Server) handleConnection(netConn net.Conn) {
+	sourceIP := netConn.RemoteAddr().(*net.TCPAddr).IP.String()
+	connLog := s.Log.With(log.Fields{"peer_ip": sourceIP})
+	c := newConn(netConn, connLog)
+	go c.writePump()
+	go c.watchdog()
+	c.readLoop(func(f frame) {
+		msg, err := decodePayload(f.msgType, f.payload)
+		if err != nil {
+			connLog.Errorf("error decoding frame: %s", err.Error())
+			_ = c.sendControl(msgTypeError, f.sessionID)
+			return
+		}
+		s.dispatch(c, sourceIP, msg, f.sessionID, connLog.With(log.Fields{"session_id": f.sessionID, "msg_type": fmt.Sprintf("%T", msg)}))
+	})
+}
+
+// dispatch applies the ban check and then routes a decoded Message to the
+// handling logic for its concrete type. c is the connection the message
+// arrived on; handshake replies are written straight back over it instead
+// of opening a fresh connection, since the connection is now persistent.
+// sessionID is the session ID the inbound frame carried; replies reuse it
+// via c.sendCorrelated so the two ends can match a reply to the round that
+// prompted it even while other rounds with the same peer are in flight on
+// the shared connection. connLog already carries peer_ip, session_id, and
+// msg_type; dispatch adds peer_mac once the message is decoded enough to
+// know it.
+func (s *Server) dispatch(c *Conn, sourceIP string, msg Message, sessionID uint64, connLog *log.Logger) {
 	res, _ := json.Marshal(msg)
-	fmt.Printf("RECEIVED MESSAGE: %s\n", string(res))
+	connLog.Debugf("received message: %s", string(res))
 
-	sourceIP := conn.RemoteAddr().(*net.TCPAddr).IP.String()
 	sourceMAC, sourceUsername := msg.SourceID()
+	connLog = connLog.With(log.Fields{"peer_mac": sourceMAC})
 	if sourceMAC == "" || sourceUsername == "" {
-		log.Panicln("Received ill-formatted message")
+		connLog.Warnf("received ill-formatted message, closing connection")
+		c.Close()
+		return
 	}
 	if msg.DestID() != s.User.Username {
-		fmt.Println("Received a message but it was not for me.")
+		connLog.Debugf("received a message but it was not for me")
 		return
 	}
+	fp := sourceFingerprint{MAC: sourceMAC, IP: sourceIP, Username: sourceUsername}
+	if s.isBanned(fp) {
+		connLog.Warnf("rejected message from banned source %+v", fp)
+		return
+	}
+
 	messageYourself := sourceMAC == s.User.MAC && sourceUsername == s.User.Username
 	sessions := s.GetSessionsWithFriend(sourceMAC, sourceUsername)
 	friend := s.User.GetFriendByUsernameAndMAC(sourceUsername, sourceMAC)
@@ -81,16 +214,19 @@ func (s *Server) handleConnection(conn *net.TCPConn) {
 			// TODO: start listener server again in week 4
 			s.User.AddFriend(friendDisplayName, sourceMAC, sourceIP, sourceUsername)
 
-			s.SendFriendRequest(sourceIP, sourceUsername)
+			s.SendFriendRequest(sourceIP, sourceMAC, sourceUsername)
 		}
 	case *HandshakeMessage:
 		// We are in a handshake, so the friend should exist already
 		if friend == nil {
-			log.Panicln("You must be a friend to participate in a handshake")
+			connLog.Errorf("received a handshake from a non-friend, closing connection")
+			c.Close()
+			return
 		}
 		var createdSession bool
 		var sess Session
 		round := msg.(*HandshakeMessage).Round
+		connLog = connLog.With(log.Fields{"round": round})
 		protoType, startSessionTime := msg.(*HandshakeMessage).ProtoType, msg.(*HandshakeMessage).SessionTime
 
 		// In a handshake, create a new session if there aren't the required number of sessions in either situation
@@ -100,7 +236,7 @@ func (s *Server) handleConnection(conn *net.TCPConn) {
 			createdSession = true
 		} else if len(sessions) == 2 && messageYourself {
 			// Communicating between yourself, rotate sessions based on round (even/odd)
-			sess = sessions[round % 2]
+			sess = sessions[round%2]
 		} else {
 			sess = sessions[0]
 		}
@@ -120,13 +256,24 @@ func (s *Server) handleConnection(conn *net.TCPConn) {
 					reply.SessionTime = time.Now()
 				}
 				reply.Round = round + 1
-				s.sendMessage(sourceIP, reply)
+				// Reply on the connection this round arrived on, tagged with
+				// the same session ID the inbound round carried, rather than
+				// dialing fresh or minting a new session ID. That's what
+				// lets concurrent rounds with this peer - or concurrent
+				// handshakes with different peers sharing one relay-brokered
+				// connection - stay correlated on one shared, framed
+				// connection.
+				if err := c.sendCorrelated(msgTypeHandshake, reply, sessionID); err != nil {
+					connLog.Errorf("failed to send handshake reply: %s", err.Error())
+				}
 			}
 			return
 		default:
 			// another type of error, which means err is probably not nil
 			if err != nil {
-				log.Panicf("ReceiveMessage: %s, Error Type: %s", err.Error(), errorType)
+				connLog.Errorf("ReceiveMessage: %s, error type: %T, closing connection", err.Error(), errorType)
+				c.Close()
+				return
 			}
 		}
 	case *ChatMessage:
@@ -142,7 +289,14 @@ func (s *Server) handleConnection(conn *net.TCPConn) {
 		if sess.Proto.IsActive() && dec[0] != nil {
 			// Print the decoded message and IP
 			fmt.Printf("%s: %s\n", friend.DisplayName, dec[0])
+			if err := c.sendControl(msgTypeAck, sessionID); err != nil {
+				connLog.Warnf("failed to ack chat message: %s", err.Error())
+			}
 		}
+	case *RoomMessage:
+		s.dispatchRoomMessage(sourceUsername, msg.(*RoomMessage))
+	case *RoomKeyUpdate:
+		s.dispatchRoomKeyUpdate(sourceMAC, sourceUsername, msg.(*RoomKeyUpdate))
 	}
 }
 
@@ -163,10 +317,17 @@ func initDialer(address string) (*net.TCPConn, error) {
 	return net.DialTCP(Network, nil, tcpAddr)
 }
 
-// Start up server
-func (s *Server) Start(username string, mac string, ip string) error {
+// Start up server. enableDiscovery opts into broadcasting and listening for
+// LAN peer auto-discovery beacons. relays is an optional list of relay
+// control/data endpoint pairs (e.g. {Control: "relay.example.com:4243",
+// Data: "relay.example.com:4244"}) to register with, so that peers behind a
+// NAT or firewall can still be reached via sendMessage's relay fallback.
+func (s *Server) Start(username string, mac string, ip string, enableDiscovery bool, relays ...relay.Endpoint) error {
 	var err error
-	log.Println("Launching Server...")
+	if s.Log == nil {
+		s.Log = log.Default
+	}
+	s.Log.Infof("launching server")
 	(*s).User = &db.User{username, mac, ip}
 	ipAddr := fmt.Sprintf("%s:%d", ip, Port)
 	if (*s).Listener, err = setupServer(ipAddr); err != nil {
@@ -174,8 +335,32 @@ func (s *Server) Start(username string, mac string, ip string) error {
 	}
 	// Initialize the session struct to a pointer
 	(*s).Sessions = &[]Session{}
+	if (*s).Bans, err = auth.NewBanList(); err != nil {
+		return err
+	}
+	(*s).pool = newConnPool()
+	(*s).rooms = make(map[string]*roomSession)
+	if err := s.loadRooms(); err != nil {
+		return err
+	}
 	go s.receive()
-	log.Printf("Listening on: '%s:%d'", ip, Port)
+	s.Log.Infof("listening on %s:%d", ip, Port)
+
+	if enableDiscovery {
+		if (*s).disco, err = discovery.Start(username, mac, ip, Port); err != nil {
+			s.Log.Warnf("discovery: failed to start: %s", err.Error())
+		}
+	}
+
+	for _, ep := range relays {
+		client, err := relay.Dial(ep.Control, ep.Data, relay.ClientID{MAC: mac, Username: username}, &tls.Config{})
+		if err != nil {
+			s.Log.Warnf("relay: failed to register with %s: %s", ep.Control, err.Error())
+			continue
+		}
+		(*s).relays = append((*s).relays, client)
+		go s.receiveFromRelay(client)
+	}
 
 	// Updates the IP address of the user and create a friend for yourself
 	if s.User.GetFriendByDisplayName(core.Self) == nil {
@@ -188,23 +373,140 @@ func (s *Server) Start(username string, mac string, ip string) error {
 	return nil
 }
 
+// DiscoveredPeers returns every peer whose beacon this server has seen
+// recently, or nil if discovery was never enabled via Start.
+func (s *Server) DiscoveredPeers() []discovery.Peer {
+	if s.disco == nil {
+		return nil
+	}
+	return s.disco.Peers()
+}
+
+// IsFriend reports whether displayName names an existing friend, so a
+// caller can tell a friend's name apart from a reserved CLI verb that
+// happens to match it (e.g. a friend literally named "ban" or "discover").
+func (s *Server) IsFriend(displayName string) bool {
+	return s.User.IsFriendsWith(displayName)
+}
+
 // End server connection
 func (s *Server) Shutdown() error {
-	log.Println("Shutting Down Server...")
+	s.Log.Infof("shutting down server")
+	for _, client := range (*s).relays {
+		client.Close()
+	}
+	if s.disco != nil {
+		s.disco.Stop()
+	}
+	if s.pool != nil {
+		s.pool.mu.Lock()
+		for _, c := range s.pool.conns {
+			c.Close()
+		}
+		s.pool.mu.Unlock()
+	}
 	return (*s).Listener.Close()
 }
 
-// Sends a formatted Message object with the server, after an active session between the two users have been established
-func (s *Server) sendMessage(destIp string, msg Message) error {
-	dialer, err := initDialer(fmt.Sprintf("%s:%d", destIp, Port))
+// receiveFromRelay waits for invitations a relay forwards on our behalf and
+// feeds the resulting data connections through handleConnection, the same
+// path used for direct accepts, so OTR and gob decoding work identically.
+func (s *Server) receiveFromRelay(client *relay.Client) {
+	for {
+		conn, err := client.WaitForInvitation()
+		if err != nil {
+			return
+		}
+		go s.handleConnection(conn)
+	}
+}
+
+// connFor returns the pooled connection for key, dialing a fresh one and
+// registering it in the pool if none is already open. It tries a direct TCP
+// dial to ip first and, if that fails, falls back to asking a registered
+// relay to broker a data connection - either way the result is wrapped in
+// the same Conn machinery (writePump, watchdog, readLoop) and pooled under
+// key, so a relay-mediated peer gets the same persistent, multi-round
+// connection a direct peer does instead of being torn down after one frame.
+// The dialed connection's replies flow back through the usual
+// handleConnection dispatch path, same as an accepted connection. The whole
+// check-dial-put sequence is serialized per key, so two concurrent
+// sendMessage calls to the same not-yet-pooled peer don't each dial their
+// own connection and leak whichever one loses the race to be pooled.
+func (s *Server) connFor(key peerKey, ip string) (*Conn, error) {
+	if c := s.pool.get(key); c != nil {
+		return c, nil
+	}
+	dialLock := s.pool.lockDial(key)
+	dialLock.Lock()
+	defer dialLock.Unlock()
+	if c := s.pool.get(key); c != nil {
+		return c, nil
+	}
+	netConn, err := initDialer(fmt.Sprintf("%s:%d", ip, Port))
 	if err != nil {
-		return err
+		if netConn, err = s.dialViaRelay(key); err != nil {
+			return nil, err
+		}
+	}
+	connLog := s.Log.With(log.Fields{"peer_mac": key.MAC, "peer_ip": ip})
+	c := newConn(netConn, connLog)
+	c.closeHook = func() { s.pool.remove(key, c) }
+	go c.writePump()
+	go c.watchdog()
+	go c.readLoop(func(f frame) {
+		msg, err := decodePayload(f.msgType, f.payload)
+		if err != nil {
+			connLog.Errorf("error decoding frame: %s", err.Error())
+			_ = c.sendControl(msgTypeError, f.sessionID)
+			return
+		}
+		s.dispatch(c, ip, msg, f.sessionID, connLog.With(log.Fields{"session_id": f.sessionID, "msg_type": fmt.Sprintf("%T", msg)}))
+	})
+	s.pool.put(key, c)
+	return c, nil
+}
+
+// dialViaRelay asks each registered relay in turn to broker a data
+// connection to key, returning the first one that succeeds.
+func (s *Server) dialViaRelay(key peerKey) (net.Conn, error) {
+	if len(s.relays) == 0 {
+		return nil, errors.New("sendMessage: peer unreachable directly and no relays are configured")
+	}
+	dest := relay.ClientID{MAC: key.MAC, Username: key.Username}
+	var lastErr error
+	for _, client := range s.relays {
+		conn, err := client.Invite(dest)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return conn, nil
 	}
+	return nil, lastErr
+}
 
-	encoder := gob.NewEncoder(dialer)
-	if err := encoder.Encode(&msg); err != nil {
+// Sends a formatted Message object with the server, after an active session between the two users have been established.
+// It looks up (or dials) a pooled, persistent connection to the peer first -
+// direct if possible, else relayed - and retries once against a fresh
+// connection if the pooled one turns out to be dead.
+func (s *Server) sendMessage(destIp string, destMAC string, destUsername string, msg Message) error {
+	mt, err := msgTypeFor(msg)
+	if err != nil {
 		return err
 	}
+	key := peerKey{MAC: destMAC, Username: destUsername}
+	c, err := s.connFor(key, destIp)
+	if err != nil {
+		return err
+	}
+	if err := c.send(mt, msg); err != nil {
+		c.Close()
+		if c, err = s.connFor(key, destIp); err != nil {
+			return err
+		}
+		return c.send(mt, msg)
+	}
 	return nil
 }
 
@@ -234,7 +536,7 @@ func (s *Server) StartSession(displayName string, proto protocol.Protocol) error
 
 	firstMessage, err := proto.NewSession()
 	if err != nil {
-		log.Panicf("StartSession: Error starting new session: %s", err)
+		s.Log.Errorf("StartSession: failed to start new session: %s", err.Error())
 		return err
 	}
 
@@ -243,15 +545,36 @@ func (s *Server) StartSession(displayName string, proto protocol.Protocol) error
 	msg.Secret = []byte(firstMessage)
 	msg.ProtoType = proto.ToType()
 	msg.Round = 0
-	return s.sendMessage(friend.IP, msg)
+	return s.sendMessage(friend.IP, friend.MAC, friend.Username, msg)
 }
 
-// Sends a friend request to a specified destUsername@destIP
-func (s *Server) SendFriendRequest(destIP, destUsername string) error {
+// Sends a friend request to a specified destUsername@destIP. destMAC may be
+// left blank for a cold outbound request; it's only needed for the relay
+// fallback in sendMessage, which requires the destination's MAC to address
+// it. destIP may instead be the username of a peer discovered on the LAN
+// (see DiscoveredPeers), in which case its IP and MAC are resolved from the
+// discovery cache and destMAC/destUsername need not be supplied.
+func (s *Server) SendFriendRequest(destIP, destMAC, destUsername string) error {
+	if net.ParseIP(destIP) == nil {
+		peer, ok := s.resolveDiscovered(destIP)
+		if !ok {
+			return fmt.Errorf("server: '%s' is not an IP and was not discovered on the LAN", destIP)
+		}
+		destIP, destMAC, destUsername = peer.IP, peer.MAC, peer.Username
+	}
+
 	friendRequest := new(FriendMessage)
 	friendRequest.NewPayload(s.User.MAC, s.User.Username, destUsername)
 
-	return s.sendMessage(destIP, friendRequest)
+	return s.sendMessage(destIP, destMAC, destUsername, friendRequest)
+}
+
+// resolveDiscovered looks up a username in the discovery cache.
+func (s *Server) resolveDiscovered(username string) (discovery.Peer, bool) {
+	if s.disco == nil {
+		return discovery.Peer{}, false
+	}
+	return s.disco.Lookup(username)
 }
 
 // Sends a chat message based on friend display name
@@ -274,5 +597,5 @@ func (s *Server) SendChatMessage(friendDisplayName, message string) error {
 
 	chatMsg.NewPayload(s.User.MAC, s.User.Username, friend.Username)
 	(*chatMsg).Text = []byte(message)
-	return s.sendMessage(friend.IP, chatMsg)
-}
\ No newline at end of file
+	return s.sendMessage(friend.IP, friend.MAC, friend.Username, chatMsg)
+}